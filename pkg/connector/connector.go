@@ -0,0 +1,91 @@
+package connector
+
+import (
+	"io"
+	"time"
+
+	"github.com/facette/facette/pkg/types"
+)
+
+// Connector represents an interface for origin backends able to provide metrics data.
+type Connector interface {
+	GetPlots(query *GroupQuery, startTime, endTime time.Time, step time.Duration,
+		percentiles []float64) (map[string]*PlotResult, error)
+	Refresh(errChan chan error)
+}
+
+// ExportFormat selects the serialization used by Exporter.Export.
+type ExportFormat int
+
+// Export formats supported by Exporter.
+const (
+	ExportFormatCSV ExportFormat = iota
+	ExportFormatNDJSON
+)
+
+// Exporter is implemented by connectors able to stream a query's raw plot data for offline analysis.
+type Exporter interface {
+	Export(query *GroupQuery, startTime, endTime time.Time, step time.Duration, format ExportFormat,
+		w io.Writer) error
+}
+
+// Connectors holds the registered connector factories, indexed by connector type name.
+var Connectors = make(map[string]func(outputChan *chan [2]string, config map[string]interface{}) (interface{}, error))
+
+// OperGroupType represents the kind of aggregation operation applied across a group's series.
+type OperGroupType int
+
+// Group aggregation operation types.
+const (
+	OperGroupTypeNone OperGroupType = iota
+	OperGroupTypeAvg
+	OperGroupTypeSum
+)
+
+// Metric represents a single data source discovered on an origin, identified by its source and metric name.
+type Metric struct {
+	SourceName string
+	Name       string
+}
+
+// Serie represents a single data serie requested as part of a GroupQuery.
+type Serie struct {
+	Name   string
+	Metric *Metric
+	Scale  float64
+
+	// ConsolidationFunc requests a specific RRA consolidation function (e.g. "MIN", "MAX", "LAST") for
+	// this serie. It is ignored by connectors that do not support per-serie consolidation, and falls
+	// back to the connector's default when the underlying metric does not carry the requested CF.
+	ConsolidationFunc string
+
+	// Transforms holds the function pipeline applied to this serie before it is combined into its
+	// GroupQuery, in order.
+	Transforms []Transform
+}
+
+// GroupQuery represents a request for one or more series, optionally combined through an aggregation operation.
+type GroupQuery struct {
+	Name   string
+	Series []*Serie
+	Type   OperGroupType
+	Scale  float64
+
+	// Transforms holds the function pipeline applied to the group's combined serie, in order.
+	Transforms []Transform
+}
+
+// DefaultPlotSample is the number of plot samples a query targets when GetPlots is called with a
+// zero step, i.e. when the caller leaves the sampling rate up to the connector.
+const DefaultPlotSample = 400
+
+// PlotResult holds the plots and summary information returned for a single serie.
+type PlotResult struct {
+	Plots []types.PlotValue
+	Info  map[string]types.PlotValue
+
+	// Step is the effective step, in practice, of the returned Plots. It may differ from the step
+	// requested from GetPlots: a zero step is resolved against DefaultPlotSample, and a step finer
+	// than the origin's native resolution is rounded up to it.
+	Step time.Duration
+}
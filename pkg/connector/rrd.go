@@ -1,7 +1,10 @@
 package connector
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
@@ -18,6 +21,25 @@ import (
 type rrdMetric struct {
 	Dataset  string
 	FilePath string
+
+	// ConsolidationFuncs holds the set of consolidation functions available across the metric's RRAs
+	// (as discovered from the `rra[*].cf` keys returned by `rrd.Info` during Refresh).
+	ConsolidationFuncs map[string]bool
+
+	// LastUpdate is the timestamp of the most recent sample recorded in the underlying .rrd file, as
+	// of the last time it was (re-)read during Refresh.
+	LastUpdate time.Time
+
+	// Step is the metric's native resolution, as read from the .rrd file's `step` header.
+	Step time.Duration
+}
+
+// rrdFileCache holds the walk state captured for a single .rrd file during the previous Refresh, so
+// that subsequent refreshes can skip the costly rrd.Info call when the file is unchanged.
+type rrdFileCache struct {
+	ModTime    time.Time
+	LastUpdate time.Time
+	Datasets   map[string]bool
 }
 
 // RRDConnector represents the main structure of the RRD connector.
@@ -27,6 +49,7 @@ type RRDConnector struct {
 	Daemon     string
 	outputChan *chan [2]string
 	metrics    map[string]map[string]*rrdMetric
+	fileCache  map[string]*rrdFileCache
 }
 
 func init() {
@@ -58,6 +81,7 @@ func init() {
 			Daemon:     configDaemon,
 			outputChan: outputChan,
 			metrics:    make(map[string]map[string]*rrdMetric),
+			fileCache:  make(map[string]*rrdFileCache),
 		}, nil
 	}
 }
@@ -69,7 +93,131 @@ func (connector *RRDConnector) GetPlots(query *GroupQuery, startTime, endTime ti
 	return connector.rrdGetData(query, startTime, endTime, step, percentiles, false)
 }
 
-// Refresh triggers a full connector data update.
+// LastUpdate returns the timestamp of the most recent sample recorded for the given source/metric
+// pair, as of the last Refresh, and whether that metric is known to the connector.
+func (connector *RRDConnector) LastUpdate(source, metric string) (time.Time, bool) {
+	metrics, ok := connector.metrics[source]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	rrdMetric, ok := metrics[metric]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return rrdMetric.LastUpdate, true
+}
+
+// Export streams query's plot data to w as CSV or NDJSON, one row per bucket. CSV columns follow the
+// order of query's series (a single column named after query for an aggregated group); NDJSON objects
+// are keyed by the same names, written in encoding/json's sorted key order.
+func (connector *RRDConnector) Export(query *GroupQuery, startTime, endTime time.Time, step time.Duration,
+	format ExportFormat, w io.Writer) error {
+
+	results, err := connector.rrdGetData(query, startTime, endTime, step, nil, false)
+	if err != nil {
+		return err
+	}
+
+	serieNames := make([]string, 0, len(query.Series))
+	if query.Type != OperGroupTypeNone {
+		if _, ok := results[query.Name]; ok {
+			serieNames = append(serieNames, query.Name)
+		}
+	} else {
+		for _, serie := range query.Series {
+			if _, ok := results[serie.Name]; ok {
+				serieNames = append(serieNames, serie.Name)
+			}
+		}
+	}
+
+	rowCount := 0
+	effectiveStep := step
+
+	for _, name := range serieNames {
+		if len(results[name].Plots) > rowCount {
+			rowCount = len(results[name].Plots)
+		}
+
+		effectiveStep = results[name].Step
+	}
+
+	switch format {
+	case ExportFormatCSV:
+		return rrdExportCSV(w, serieNames, results, rowCount, startTime, effectiveStep)
+	case ExportFormatNDJSON:
+		return rrdExportNDJSON(w, serieNames, results, rowCount, startTime, effectiveStep)
+	default:
+		return fmt.Errorf("unknown `%d' export format", format)
+	}
+}
+
+// rrdExportCSV writes results as `timestamp,serie1,serie2,...` rows, rendering NaNs as empty fields.
+func rrdExportCSV(w io.Writer, serieNames []string, results map[string]*PlotResult, rowCount int,
+	startTime time.Time, step time.Duration) error {
+
+	csvWriter := csv.NewWriter(w)
+
+	if err := csvWriter.Write(append([]string{"timestamp"}, serieNames...)); err != nil {
+		return err
+	}
+
+	for i := 0; i < rowCount; i++ {
+		row := make([]string, 0, len(serieNames)+1)
+		row = append(row, strconv.FormatInt(startTime.Add(time.Duration(i)*step).Unix(), 10))
+
+		for _, name := range serieNames {
+			plots := results[name].Plots
+
+			if i >= len(plots) || math.IsNaN(float64(plots[i])) {
+				row = append(row, "")
+			} else {
+				row = append(row, strconv.FormatFloat(float64(plots[i]), 'f', -1, 64))
+			}
+		}
+
+		if err := csvWriter.Write(row); err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+
+	return csvWriter.Error()
+}
+
+// rrdExportNDJSON writes results as one JSON object per line, keyed by "timestamp" and serie name,
+// rendering NaNs as null.
+func rrdExportNDJSON(w io.Writer, serieNames []string, results map[string]*PlotResult, rowCount int,
+	startTime time.Time, step time.Duration) error {
+
+	encoder := json.NewEncoder(w)
+
+	for i := 0; i < rowCount; i++ {
+		row := make(map[string]interface{}, len(serieNames)+1)
+		row["timestamp"] = startTime.Add(time.Duration(i) * step).Unix()
+
+		for _, name := range serieNames {
+			plots := results[name].Plots
+
+			if i >= len(plots) || math.IsNaN(float64(plots[i])) {
+				row[name] = nil
+			} else {
+				row[name] = float64(plots[i])
+			}
+		}
+
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Refresh triggers an incremental connector data update.
 func (connector *RRDConnector) Refresh(errChan chan error) {
 	defer close(*connector.outputChan)
 	defer close(errChan)
@@ -132,6 +280,16 @@ func (connector *RRDConnector) Refresh(errChan chan error) {
 			connector.metrics[sourceName] = make(map[string]*rrdMetric)
 		}
 
+		// Skip files whose modification time matches the previous walk: their metrics are already
+		// up to date in connector.metrics, so just republish them and avoid the costly rrd.Info call.
+		if cached, ok := connector.fileCache[filePath]; ok && cached.ModTime.Equal(fileInfo.ModTime()) {
+			for dsName := range cached.Datasets {
+				*connector.outputChan <- [2]string{sourceName, metricName + "/" + dsName}
+			}
+
+			return nil
+		}
+
 		// Extract metric information from .rrd file
 		info, err := rrd.Info(filePath)
 		if err != nil {
@@ -139,12 +297,31 @@ func (connector *RRDConnector) Refresh(errChan chan error) {
 			return nil
 		}
 
+		datasets := make(map[string]bool)
+
 		if _, ok := info["ds.index"]; ok {
+			cfs := rrdConsolidationFuncs(info)
+			lastUpdate := rrdInfoLastUpdate(info)
+			nativeStep := rrdInfoStep(info)
+
 			for dsName := range info["ds.index"].(map[string]interface{}) {
 				metricFullName := metricName + "/" + dsName
+				datasets[dsName] = true
 
 				*connector.outputChan <- [2]string{sourceName, metricFullName}
-				connector.metrics[sourceName][metricFullName] = &rrdMetric{Dataset: dsName, FilePath: filePath}
+				connector.metrics[sourceName][metricFullName] = &rrdMetric{
+					Dataset:            dsName,
+					FilePath:           filePath,
+					ConsolidationFuncs: cfs,
+					LastUpdate:         lastUpdate,
+					Step:               nativeStep,
+				}
+			}
+
+			connector.fileCache[filePath] = &rrdFileCache{
+				ModTime:    fileInfo.ModTime(),
+				LastUpdate: lastUpdate,
+				Datasets:   datasets,
 			}
 		}
 
@@ -168,6 +345,8 @@ func (connector *RRDConnector) rrdGetData(query *GroupQuery, startTime, endTime
 		query.Type = OperGroupTypeNone
 	}
 
+	effectiveStep := rrdEffectiveStep(connector.rrdNativeStep(query), startTime, endTime, step)
+
 	result := make(map[string]*PlotResult)
 	series := make(map[string]string)
 
@@ -201,11 +380,15 @@ func (connector *RRDConnector) rrdGetData(query *GroupQuery, startTime, endTime
 
 			count += 1
 
+			metric := connector.metrics[serie.Metric.SourceName][serie.Metric.Name]
+			cf := rrdConsolidationFunc(metric, rrdRequestedCF(serie.ConsolidationFunc, serie.Transforms))
+			filePath := rrdEscape(metric.FilePath)
+
 			graph.Def(
 				serieTemp+"-orig0",
-				connector.metrics[serie.Metric.SourceName][serie.Metric.Name].FilePath,
-				connector.metrics[serie.Metric.SourceName][serie.Metric.Name].Dataset,
-				"AVERAGE",
+				filePath,
+				metric.Dataset,
+				cf,
 			)
 
 			if serie.Scale != 0 {
@@ -220,16 +403,19 @@ func (connector *RRDConnector) rrdGetData(query *GroupQuery, startTime, endTime
 				graph.CDef(serieTemp, serieTemp+"-orig1")
 			}
 
+			serieAfterSerie := rrdCompileTransforms(graph, serieTemp, serie.Transforms)
+			serieFinal := rrdCompileTransforms(graph, serieAfterSerie, query.Transforms)
+
 			// Set graph information request
-			rrdSetGraph(graph, serieTemp, serieName, percentiles)
+			rrdSetGraph(graph, serieFinal, serieName, percentiles)
 
 			// Set plots request
 			if !infoOnly {
 				xport.Def(
 					serieTemp+"-orig0",
-					connector.metrics[serie.Metric.SourceName][serie.Metric.Name].FilePath,
-					connector.metrics[serie.Metric.SourceName][serie.Metric.Name].Dataset,
-					"AVERAGE",
+					filePath,
+					metric.Dataset,
+					cf,
 				)
 
 				if serie.Scale != 0 {
@@ -244,11 +430,14 @@ func (connector *RRDConnector) rrdGetData(query *GroupQuery, startTime, endTime
 					xport.CDef(serieTemp, serieTemp+"-orig1")
 				}
 
-				xport.XportDef(serieTemp, serieTemp)
+				rrdCompileTransforms(xport, serieTemp, serie.Transforms)
+				rrdCompileTransforms(xport, serieAfterSerie, query.Transforms)
+
+				xport.XportDef(serieFinal, serieFinal)
 			}
 
 			// Set serie matching
-			series[serieTemp] = serieName
+			series[serieFinal] = serieName
 		}
 
 	case OperGroupTypeAvg, OperGroupTypeSum:
@@ -262,30 +451,36 @@ func (connector *RRDConnector) rrdGetData(query *GroupQuery, startTime, endTime
 
 			serieTemp := serieName + fmt.Sprintf("-tmp%d", index)
 
+			metric := connector.metrics[serie.Metric.SourceName][serie.Metric.Name]
+			cf := rrdConsolidationFunc(metric, rrdRequestedCF(serie.ConsolidationFunc, serie.Transforms))
+			filePath := rrdEscape(metric.FilePath)
+
 			graph.Def(
 				serieTemp+"-ori",
-				connector.metrics[serie.Metric.SourceName][serie.Metric.Name].FilePath,
-				connector.metrics[serie.Metric.SourceName][serie.Metric.Name].Dataset,
-				"AVERAGE",
+				filePath,
+				metric.Dataset,
+				cf,
 			)
 
 			graph.CDef(serieTemp, fmt.Sprintf("%s-ori,UN,0,%s-ori,IF", serieTemp, serieTemp))
+			serieFinal := rrdCompileTransforms(graph, serieTemp, serie.Transforms)
 
 			if !infoOnly {
 				xport.Def(
 					serieTemp+"-ori",
-					connector.metrics[serie.Metric.SourceName][serie.Metric.Name].FilePath,
-					connector.metrics[serie.Metric.SourceName][serie.Metric.Name].Dataset,
-					"AVERAGE",
+					filePath,
+					metric.Dataset,
+					cf,
 				)
 
 				xport.CDef(serieTemp, fmt.Sprintf("%s-ori,UN,0,%s-ori,IF", serieTemp, serieTemp))
+				rrdCompileTransforms(xport, serieTemp, serie.Transforms)
 			}
 
 			if len(stack) == 0 {
-				stack = append(stack, serieTemp)
+				stack = append(stack, serieFinal)
 			} else {
-				stack = append(stack, serieTemp, "+")
+				stack = append(stack, serieFinal, "+")
 			}
 		}
 
@@ -301,8 +496,10 @@ func (connector *RRDConnector) rrdGetData(query *GroupQuery, startTime, endTime
 			graph.CDef(serieName, serieName+"-orig")
 		}
 
+		groupFinal := rrdCompileTransforms(graph, serieName, query.Transforms)
+
 		// Set graph information request
-		rrdSetGraph(graph, serieName, query.Name, percentiles)
+		rrdSetGraph(graph, groupFinal, query.Name, percentiles)
 
 		// Set plots request
 		if !infoOnly {
@@ -314,11 +511,13 @@ func (connector *RRDConnector) rrdGetData(query *GroupQuery, startTime, endTime
 				xport.CDef(serieName, serieName+"-orig")
 			}
 
-			xport.XportDef(serieName, serieName)
+			rrdCompileTransforms(xport, serieName, query.Transforms)
+
+			xport.XportDef(groupFinal, groupFinal)
 		}
 
 		// Set serie matching
-		series[serieName] = query.Name
+		series[groupFinal] = query.Name
 
 	default:
 		return nil, fmt.Errorf("unknown `%d' operator type", query.Type)
@@ -328,13 +527,22 @@ func (connector *RRDConnector) rrdGetData(query *GroupQuery, startTime, endTime
 	data := rrd.XportResult{}
 
 	if !infoOnly {
-		data, err := xport.Xport(startTime, endTime, step)
+		var err error
+
+		data, err = xport.Xport(startTime, endTime, effectiveStep)
 		if err != nil {
 			return nil, err
 		}
 
+		// rrdtool picks RRAs based on the requested span, not just the requested step, so the step it
+		// actually exported at may differ from effectiveStep: trust data.Step over our own estimate.
+		actualStep := data.Step
+		if actualStep == 0 {
+			actualStep = effectiveStep
+		}
+
 		for index, serieName := range data.Legends {
-			result[series[serieName]] = &PlotResult{Info: make(map[string]types.PlotValue)}
+			result[series[serieName]] = &PlotResult{Info: make(map[string]types.PlotValue), Step: actualStep}
 
 			for i := 0; i < data.RowCnt; i++ {
 				result[series[serieName]].Plots = append(result[series[serieName]].Plots,
@@ -349,14 +557,197 @@ func (connector *RRDConnector) rrdGetData(query *GroupQuery, startTime, endTime
 		return nil, err
 	}
 
-	rrdParseInfo(graphInfo, result)
+	rrdParseInfo(graphInfo, result, effectiveStep)
 
 	data.FreeValues()
 
 	return result, nil
 }
 
-func rrdParseInfo(info rrd.GraphInfo, data map[string]*PlotResult) {
+// rrdNativeStep returns the coarsest native step across all the metrics referenced by query's series.
+func (connector *RRDConnector) rrdNativeStep(query *GroupQuery) time.Duration {
+	var nativeStep time.Duration
+
+	for _, serie := range query.Series {
+		if serie.Metric == nil {
+			continue
+		}
+
+		metric := connector.metrics[serie.Metric.SourceName][serie.Metric.Name]
+		if metric != nil && metric.Step > nativeStep {
+			nativeStep = metric.Step
+		}
+	}
+
+	return nativeStep
+}
+
+// rrdEffectiveStep resolves the step a query should actually be run at: a zero step defaults to the
+// coarser of nativeStep and a step sized to yield DefaultPlotSample samples over the requested
+// interval, and a step finer than nativeStep is rounded up to the nearest multiple of it.
+func rrdEffectiveStep(nativeStep time.Duration, startTime, endTime time.Time, step time.Duration) time.Duration {
+	if nativeStep <= 0 {
+		nativeStep = time.Second
+	}
+
+	if step == 0 {
+		sampledStep := endTime.Sub(startTime) / DefaultPlotSample
+		if sampledStep > nativeStep {
+			return sampledStep
+		}
+
+		return nativeStep
+	}
+
+	if step < nativeStep {
+		multiples := (step + nativeStep - 1) / nativeStep
+		if multiples < 1 {
+			multiples = 1
+		}
+
+		return multiples * nativeStep
+	}
+
+	return step
+}
+
+var rrdEscaper = strings.NewReplacer(`\`, `\\`, `:`, `\:`)
+
+// rrdEscape backslash-escapes characters reserved by RRDtool's DEF syntax (`:' separates a DEF's
+// fields, `\' is the escape character itself), so that FilePaths containing them — e.g. Windows UNC
+// shares, or paths embedding a timestamp — can be passed safely to graph.Def and xport.Def.
+func rrdEscape(path string) string {
+	return rrdEscaper.Replace(path)
+}
+
+// rrdInfoLastUpdate extracts the `last_update` timestamp from the map returned by `rrd.Info`.
+func rrdInfoLastUpdate(info map[string]interface{}) time.Time {
+	value, ok := info["last_update"]
+	if !ok {
+		return time.Time{}
+	}
+
+	switch v := value.(type) {
+	case int64:
+		return time.Unix(v, 0)
+	case int:
+		return time.Unix(int64(v), 0)
+	case uint:
+		return time.Unix(int64(v), 0)
+	case uint64:
+		return time.Unix(int64(v), 0)
+	default:
+		return time.Time{}
+	}
+}
+
+// rrdInfoStep extracts the `step` (native resolution, in seconds) from the map returned by `rrd.Info`.
+func rrdInfoStep(info map[string]interface{}) time.Duration {
+	value, ok := info["step"]
+	if !ok {
+		return 0
+	}
+
+	switch v := value.(type) {
+	case int64:
+		return time.Duration(v) * time.Second
+	case int:
+		return time.Duration(v) * time.Second
+	case uint:
+		return time.Duration(v) * time.Second
+	case uint64:
+		return time.Duration(v) * time.Second
+	default:
+		return 0
+	}
+}
+
+// rrdConsolidationFuncs extracts the set of consolidation functions available across a .rrd file's RRAs
+// from the map returned by `rrd.Info`, which folds the per-RRA `rra[N].cf` keys into a single `rra.cf`
+// slice indexed by N.
+func rrdConsolidationFuncs(info map[string]interface{}) map[string]bool {
+	cfs := make(map[string]bool)
+
+	values, _ := info["rra.cf"].([]interface{})
+
+	for _, value := range values {
+		if cf, ok := value.(string); ok {
+			cfs[cf] = true
+		}
+	}
+
+	return cfs
+}
+
+// rrdConsolidationFunc returns the consolidation function requested for a serie, falling back to
+// AVERAGE when none was requested or when the metric's RRAs do not carry the requested CF.
+func rrdConsolidationFunc(metric *rrdMetric, requested string) string {
+	if requested == "" || !metric.ConsolidationFuncs[requested] {
+		return "AVERAGE"
+	}
+
+	return requested
+}
+
+// rrdRequestedCF resolves the consolidation function to request for a Def: an explicit
+// ConsolidateBy transform in the pipeline takes precedence over the serie's ConsolidationFunc field.
+func rrdRequestedCF(consolidationFunc string, transforms []Transform) string {
+	for _, transform := range transforms {
+		if transform.Kind == TransformConsolidateBy {
+			return transform.CF
+		}
+	}
+
+	return consolidationFunc
+}
+
+// rrdCDefTarget is satisfied by both *rrd.Grapher and *rrd.Exporter, letting rrdCompileTransforms
+// append CDef steps to either one without duplicating the RPN translation.
+type rrdCDefTarget interface {
+	CDef(name, rpn string)
+}
+
+// rrdCompileTransforms appends one CDef step per pipeline transform to target, chaining from
+// baseName, and returns the name holding the pipeline's output (baseName itself if transforms is
+// empty). TransformConsolidateBy is skipped here: in a Serie's Transforms it is applied earlier, when
+// selecting the Def's consolidation function via rrdRequestedCF; in a GroupQuery's Transforms it has
+// no effect.
+func rrdCompileTransforms(target rrdCDefTarget, baseName string, transforms []Transform) string {
+	current := baseName
+
+	for index, transform := range transforms {
+		if transform.Kind == TransformConsolidateBy {
+			continue
+		}
+
+		step := fmt.Sprintf("%s-xf%d", baseName, index)
+
+		switch transform.Kind {
+		case TransformNull:
+			target.CDef(step, fmt.Sprintf("%s,UN,%f,%s,IF", current, transform.Arg, current))
+		case TransformMovingAverage:
+			target.CDef(step, fmt.Sprintf("%s,%f,TREND", current, transform.Arg))
+		case TransformDerivative:
+			target.CDef(step, fmt.Sprintf("%s,PREV(%s),-", current, current))
+		case TransformNonNegativeDerivative:
+			target.CDef(step, fmt.Sprintf("%s,PREV(%s),-,0,MAX", current, current))
+		case TransformScale:
+			target.CDef(step, fmt.Sprintf("%s,%f,*", current, transform.Arg))
+		case TransformOffset:
+			target.CDef(step, fmt.Sprintf("%s,%f,+", current, transform.Arg))
+		case TransformAbsoluteValue:
+			target.CDef(step, fmt.Sprintf("%s,ABS", current))
+		default:
+			continue
+		}
+
+		current = step
+	}
+
+	return current
+}
+
+func rrdParseInfo(info rrd.GraphInfo, data map[string]*PlotResult, step time.Duration) {
 	for _, value := range info.Print {
 		chunks := strings.SplitN(value, ",", 3)
 
@@ -366,7 +757,7 @@ func rrdParseInfo(info rrd.GraphInfo, data map[string]*PlotResult) {
 		}
 
 		if data[chunks[0]] == nil {
-			data[chunks[0]] = &PlotResult{Info: make(map[string]types.PlotValue)}
+			data[chunks[0]] = &PlotResult{Info: make(map[string]types.PlotValue), Step: step}
 		}
 
 		data[chunks[0]].Info[chunks[1]] = types.PlotValue(chunkFloat)
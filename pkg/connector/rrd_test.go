@@ -0,0 +1,613 @@
+package connector
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facette/facette/thirdparty/github.com/ziutek/rrd"
+)
+
+func TestRrdEffectiveStep(t *testing.T) {
+	start := time.Unix(0, 0)
+
+	cases := []struct {
+		name       string
+		nativeStep time.Duration
+		interval   time.Duration
+		step       time.Duration
+		expected   time.Duration
+	}{
+		{
+			name:       "zero step keeps the native step when it is coarser than the sampled rate",
+			nativeStep: 5 * time.Minute,
+			interval:   time.Hour,
+			step:       0,
+			expected:   5 * time.Minute,
+		},
+		{
+			name:       "zero step falls back to the sampled rate when it is coarser than native",
+			nativeStep: time.Second,
+			interval:   time.Duration(DefaultPlotSample) * time.Minute,
+			step:       0,
+			expected:   time.Minute,
+		},
+		{
+			name:       "a step finer than native is rounded up to a multiple of native",
+			nativeStep: 5 * time.Minute,
+			interval:   time.Hour,
+			step:       90 * time.Second,
+			expected:   5 * time.Minute,
+		},
+		{
+			name:       "a step at or coarser than native is left unchanged",
+			nativeStep: time.Minute,
+			interval:   time.Hour,
+			step:       10 * time.Minute,
+			expected:   10 * time.Minute,
+		},
+		{
+			name:       "a zero native step falls back to a 1s floor",
+			nativeStep: 0,
+			interval:   10 * time.Second,
+			step:       0,
+			expected:   time.Second,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			end := start.Add(c.interval)
+
+			if got := rrdEffectiveStep(c.nativeStep, start, end, c.step); got != c.expected {
+				t.Errorf("rrdEffectiveStep(%s, _, _, %s) = %s, want %s", c.nativeStep, c.step, got, c.expected)
+			}
+		})
+	}
+}
+
+func TestRrdEscape(t *testing.T) {
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{`/var/lib/rrd/host1/cpu.rrd`, `/var/lib/rrd/host1/cpu.rrd`},
+		{`C:\rrd\host1\cpu.rrd`, `C\:\\rrd\\host1\\cpu.rrd`},
+		{`/srv/rrd/2016-01-01T00:00:00/cpu.rrd`, `/srv/rrd/2016-01-01T00\:00\:00/cpu.rrd`},
+	}
+
+	for _, c := range cases {
+		if got := rrdEscape(c.path); got != c.expected {
+			t.Errorf("rrdEscape(%q) = %q, want %q", c.path, got, c.expected)
+		}
+	}
+}
+
+// newTestRRDConnector creates a single-metric "host1/cpu.rrd" under a fresh temp directory whose name
+// starts with dirPrefix, refreshes an RRDConnector over it, and returns the connector along with a GroupQuery
+// matching its one serie and the RRD's start time.
+func newTestRRDConnector(t *testing.T, dirPrefix string) (*RRDConnector, *GroupQuery, time.Time) {
+	t.Helper()
+
+	tmpDir, err := ioutil.TempDir("", dirPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	rrdPath := filepath.Join(tmpDir, "host1", "cpu.rrd")
+	if err := os.MkdirAll(filepath.Dir(rrdPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-24 * time.Hour)
+
+	creator := rrd.NewCreator(rrdPath, start, 60)
+	creator.DS("value", "GAUGE", 120, 0, 100)
+	creator.RRA("AVERAGE", 0.5, 1, 1440)
+
+	if err := creator.Create(true); err != nil {
+		t.Fatalf("failed to create test RRD file: %s", err)
+	}
+
+	outputChan := make(chan [2]string, 16)
+	errChan := make(chan error, 1)
+
+	connector := &RRDConnector{
+		Path:       tmpDir,
+		Pattern:    `^(?P<source>[^/]+)/(?P<metric>[^/]+)\.rrd$`,
+		outputChan: &outputChan,
+		metrics:    make(map[string]map[string]*rrdMetric),
+		fileCache:  make(map[string]*rrdFileCache),
+	}
+
+	go connector.Refresh(errChan)
+
+	for range outputChan {
+	}
+
+	if err := <-errChan; err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+
+	query := &GroupQuery{
+		Name: "cpu",
+		Series: []*Serie{
+			{Name: "value", Metric: &Metric{SourceName: "host1", Name: "cpu/value"}},
+		},
+	}
+
+	return connector, query, start
+}
+
+// TestRefreshSkipsUnchangedFilesAndTracksLastUpdate exercises the two-call incremental Refresh path:
+// the first call populates fileCache from rrd.Info, and the second call must hit the mtime-skip
+// branch (the .rrd file is untouched in between) while still republishing the metric on
+// outputChan and leaving LastUpdate intact.
+func TestRefreshSkipsUnchangedFilesAndTracksLastUpdate(t *testing.T) {
+	connector, _, start := newTestRRDConnector(t, "facette-rrd-refresh-")
+
+	lastUpdate, ok := connector.LastUpdate("host1", "cpu/value")
+	if !ok {
+		t.Fatal("expected LastUpdate to know about host1/cpu/value after the first Refresh")
+	}
+	if diff := lastUpdate.Sub(start); diff < -time.Second || diff > time.Second {
+		t.Errorf("LastUpdate = %s, want close to the RRD's creation time %s", lastUpdate, start)
+	}
+
+	rrdPath := filepath.Join(connector.Path, "host1", "cpu.rrd")
+
+	cachedEntry := connector.fileCache[rrdPath]
+	if cachedEntry == nil {
+		t.Fatal("expected the first Refresh to populate fileCache for the .rrd file")
+	}
+
+	outputChan := make(chan [2]string, 16)
+	errChan := make(chan error, 1)
+	connector.outputChan = &outputChan
+
+	go connector.Refresh(errChan)
+
+	var republished []string
+	for entry := range outputChan {
+		republished = append(republished, entry[0]+"/"+entry[1])
+	}
+
+	if err := <-errChan; err != nil {
+		t.Fatalf("second Refresh failed: %s", err)
+	}
+
+	if len(republished) != 1 || republished[0] != "host1/cpu/value" {
+		t.Errorf("expected the unchanged-file skip branch to still republish host1/cpu/value, got %v", republished)
+	}
+
+	if connector.fileCache[rrdPath] != cachedEntry {
+		t.Error("expected the unchanged-file skip branch to leave the cached fileCache entry untouched")
+	}
+
+	secondLastUpdate, ok := connector.LastUpdate("host1", "cpu/value")
+	if !ok || !secondLastUpdate.Equal(lastUpdate) {
+		t.Errorf("LastUpdate after the skip-branch Refresh = %s (ok=%v), want unchanged %s", secondLastUpdate, ok, lastUpdate)
+	}
+}
+
+// TestGetPlotsWithColonInPath is a regression test for paths containing `:' (e.g. a directory name
+// embedding a timestamp), which used to break graph.Def/xport.Def silently.
+func TestGetPlotsWithColonInPath(t *testing.T) {
+	connector, query, start := newTestRRDConnector(t, "facette-rrd-2016-01-01T00:00:00-")
+
+	if _, err := connector.GetPlots(query, start, time.Now(), 60*time.Second, nil); err != nil {
+		t.Fatalf("GetPlots on a path containing `:' failed: %s", err)
+	}
+}
+
+func TestExportCSVAndNDJSON(t *testing.T) {
+	connector, query, start := newTestRRDConnector(t, "facette-rrd-export-")
+
+	var csvBuf strings.Builder
+	if err := connector.Export(query, start, time.Now(), 60*time.Second, ExportFormatCSV, &csvBuf); err != nil {
+		t.Fatalf("CSV export failed: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimRight(csvBuf.String(), "\n"), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("expected a header and at least one data row, got %d lines", len(lines))
+	}
+	if lines[0] != "timestamp,value" {
+		t.Errorf("unexpected CSV header: %q", lines[0])
+	}
+
+	var jsonBuf strings.Builder
+	if err := connector.Export(query, start, time.Now(), 60*time.Second, ExportFormatNDJSON, &jsonBuf); err != nil {
+		t.Fatalf("NDJSON export failed: %s", err)
+	}
+
+	if !strings.Contains(jsonBuf.String(), `"value"`) {
+		t.Errorf("expected NDJSON output to mention serie `value', got %q", jsonBuf.String())
+	}
+}
+
+// newTestRRDSerie is like newTestRRDConnector, but lets the caller control the RRAs' consolidation
+// functions and pdpPerRow, and seeds the RRD with one sample per step starting right after creation.
+// It returns the ready connector, a GroupQuery matching the one serie, and the timestamp of the
+// first written sample.
+func newTestRRDSerie(t *testing.T, dirPrefix string, cfs []string, pdpPerRow uint, step time.Duration,
+	values []float64) (*RRDConnector, *GroupQuery, time.Time) {
+
+	t.Helper()
+
+	tmpDir, err := ioutil.TempDir("", dirPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	rrdPath := filepath.Join(tmpDir, "host1", "cpu.rrd")
+	if err := os.MkdirAll(filepath.Dir(rrdPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-time.Duration(len(values)+10) * step).Truncate(step)
+
+	creator := rrd.NewCreator(rrdPath, start, uint(step.Seconds()))
+	creator.DS("value", "GAUGE", uint(10*step.Seconds()), 0, 1000000)
+
+	for _, cf := range cfs {
+		creator.RRA(cf, 0.5, pdpPerRow, 2000)
+	}
+
+	if err := creator.Create(true); err != nil {
+		t.Fatalf("failed to create test RRD file: %s", err)
+	}
+
+	updater := rrd.NewUpdater(rrdPath)
+
+	ts := start
+	for _, value := range values {
+		ts = ts.Add(step)
+
+		if err := updater.Update(ts, value); err != nil {
+			t.Fatalf("failed to write sample at %s: %s", ts, err)
+		}
+	}
+
+	outputChan := make(chan [2]string, 16)
+	errChan := make(chan error, 1)
+
+	connector := &RRDConnector{
+		Path:       tmpDir,
+		Pattern:    `^(?P<source>[^/]+)/(?P<metric>[^/]+)\.rrd$`,
+		outputChan: &outputChan,
+		metrics:    make(map[string]map[string]*rrdMetric),
+		fileCache:  make(map[string]*rrdFileCache),
+	}
+
+	go connector.Refresh(errChan)
+
+	for range outputChan {
+	}
+
+	if err := <-errChan; err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+
+	query := &GroupQuery{
+		Name: "cpu",
+		Series: []*Serie{
+			{Name: "value", Metric: &Metric{SourceName: "host1", Name: "cpu/value"}},
+		},
+	}
+
+	return connector, query, start.Add(step)
+}
+
+// TestTransformMovingAverage checks that a MovingAverage transform actually smooths a step change in
+// the underlying data, rather than just passing the raw values through unchanged.
+func TestTransformMovingAverage(t *testing.T) {
+	const step = 60 * time.Second
+
+	values := make([]float64, 40)
+	for i := range values {
+		if i >= 20 {
+			values[i] = 100
+		}
+	}
+
+	connector, query, start := newTestRRDSerie(t, "facette-rrd-xf-avg-", []string{"AVERAGE"}, 1, step, values)
+	query.Series[0].Transforms = []Transform{NewMovingAverage(5 * step.Seconds())}
+
+	end := start.Add(time.Duration(len(values)) * step)
+
+	results, err := connector.GetPlots(query, start, end, step, nil)
+	if err != nil {
+		t.Fatalf("GetPlots failed: %s", err)
+	}
+
+	plots := results["value"].Plots
+	if len(plots) == 0 {
+		t.Fatal("expected plots, got none")
+	}
+
+	if last := float64(plots[len(plots)-1]); math.IsNaN(last) || last < 90 {
+		t.Errorf("expected the moving average deep into the constant region to settle near 100, got %f", last)
+	}
+
+	smoothed := false
+	for _, plot := range plots {
+		if value := float64(plot); !math.IsNaN(value) && value > 1 && value < 99 {
+			smoothed = true
+			break
+		}
+	}
+
+	if !smoothed {
+		t.Error("expected at least one transitional plot strictly between 0 and 100, showing the step was smoothed")
+	}
+}
+
+// TestTransformDerivative checks that a Derivative transform reads back the per-step rate of change
+// of a linear counter ramp.
+func TestTransformDerivative(t *testing.T) {
+	const step = 60 * time.Second
+	const increment = 10.0
+
+	values := make([]float64, 20)
+	for i := range values {
+		values[i] = float64(i) * increment
+	}
+
+	connector, query, start := newTestRRDSerie(t, "facette-rrd-xf-deriv-", []string{"AVERAGE"}, 1, step, values)
+	query.Series[0].Transforms = []Transform{NewDerivative()}
+
+	end := start.Add(time.Duration(len(values)) * step)
+
+	results, err := connector.GetPlots(query, start, end, step, nil)
+	if err != nil {
+		t.Fatalf("GetPlots failed: %s", err)
+	}
+
+	checked, matched := 0, 0
+
+	for _, plot := range results["value"].Plots {
+		value := float64(plot)
+		if math.IsNaN(value) {
+			continue
+		}
+
+		checked++
+
+		if math.Abs(value-increment) < 1 {
+			matched++
+		}
+	}
+
+	if checked == 0 {
+		t.Fatal("expected at least one non-NaN derivative plot")
+	}
+	if matched == 0 {
+		t.Errorf("expected the derivative of a constant +%.0f/step ramp to read back near %.0f, got none among %d samples",
+			increment, increment, checked)
+	}
+}
+
+// TestTransformNull is a regression test for the TransformNull RPN compiled in rrdGetData: the
+// 3-operand RRDtool `IF` requires an else-branch operand, and an earlier version of the CDef omitted
+// it, causing a stack-underflow at xport time. It checks that an UNKNOWN sample (produced here by a
+// gap wider than the DS heartbeat) reads back as the transform's default, while known samples are
+// left untouched.
+func TestTransformNull(t *testing.T) {
+	const step = 60 * time.Second
+	const heartbeat = step
+
+	tmpDir, err := ioutil.TempDir("", "facette-rrd-xf-null-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	rrdPath := filepath.Join(tmpDir, "host1", "cpu.rrd")
+	if err := os.MkdirAll(filepath.Dir(rrdPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-40 * step).Truncate(step)
+
+	creator := rrd.NewCreator(rrdPath, start, uint(step.Seconds()))
+	creator.DS("value", "GAUGE", uint(heartbeat.Seconds()), 0, 1000000)
+	creator.RRA("AVERAGE", 0.5, 1, 2000)
+
+	if err := creator.Create(true); err != nil {
+		t.Fatalf("failed to create test RRD file: %s", err)
+	}
+
+	updater := rrd.NewUpdater(rrdPath)
+
+	ts := start
+	for i := 0; i < 10; i++ {
+		ts = ts.Add(step)
+		if err := updater.Update(ts, 42.0); err != nil {
+			t.Fatalf("failed to write sample at %s: %s", ts, err)
+		}
+	}
+
+	// Skip several steps: the gap is wider than the heartbeat, so RRDtool marks this span UNKNOWN.
+	ts = ts.Add(5 * step)
+
+	for i := 0; i < 10; i++ {
+		ts = ts.Add(step)
+		if err := updater.Update(ts, 42.0); err != nil {
+			t.Fatalf("failed to write sample at %s: %s", ts, err)
+		}
+	}
+
+	end := ts
+
+	outputChan := make(chan [2]string, 16)
+	errChan := make(chan error, 1)
+
+	connector := &RRDConnector{
+		Path:       tmpDir,
+		Pattern:    `^(?P<source>[^/]+)/(?P<metric>[^/]+)\.rrd$`,
+		outputChan: &outputChan,
+		metrics:    make(map[string]map[string]*rrdMetric),
+		fileCache:  make(map[string]*rrdFileCache),
+	}
+
+	go connector.Refresh(errChan)
+
+	for range outputChan {
+	}
+
+	if err := <-errChan; err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+
+	query := &GroupQuery{
+		Name: "cpu",
+		Series: []*Serie{
+			{
+				Name:       "value",
+				Metric:     &Metric{SourceName: "host1", Name: "cpu/value"},
+				Transforms: []Transform{NewTransformNull(-1)},
+			},
+		},
+	}
+
+	results, err := connector.GetPlots(query, start, end, step, nil)
+	if err != nil {
+		t.Fatalf("GetPlots with a TransformNull failed (a stack-underflow in the RPN would fail here): %s", err)
+	}
+
+	plots := results["value"].Plots
+	if len(plots) == 0 {
+		t.Fatal("expected plots, got none")
+	}
+
+	sawDefault, sawKnown := false, false
+
+	for _, plot := range plots {
+		value := float64(plot)
+		if math.IsNaN(value) {
+			t.Fatalf("TransformNull should have replaced every UNKNOWN sample, found NaN among %v", plots)
+		}
+
+		if value == -1 {
+			sawDefault = true
+		} else if math.Abs(value-42) < 1 {
+			sawKnown = true
+		}
+	}
+
+	if !sawDefault {
+		t.Error("expected the gap to be filled with the TransformNull default (-1)")
+	}
+	if !sawKnown {
+		t.Error("expected known samples to read back unchanged (~42)")
+	}
+}
+
+// TestTransformConsolidateBy checks that a ConsolidateBy transform actually switches which RRA is
+// read, by comparing the default (AVERAGE) consolidation against an explicit ConsolidateBy("MAX")
+// over bursty data where the two clearly diverge.
+func TestTransformConsolidateBy(t *testing.T) {
+	const step = 60 * time.Second
+	const pdpPerRow = 5
+
+	values := make([]float64, 40)
+	for i := range values {
+		if i%2 != 0 {
+			values[i] = 100
+		}
+	}
+
+	connector, query, start := newTestRRDSerie(t, "facette-rrd-xf-cf-", []string{"AVERAGE", "MAX"}, pdpPerRow, step, values)
+
+	end := start.Add(time.Duration(len(values)) * step)
+	rraStep := step * pdpPerRow
+
+	avgResults, err := connector.GetPlots(query, start, end, rraStep, nil)
+	if err != nil {
+		t.Fatalf("GetPlots (default AVERAGE) failed: %s", err)
+	}
+
+	query.Series[0].Transforms = []Transform{NewConsolidateBy("MAX")}
+
+	maxResults, err := connector.GetPlots(query, start, end, rraStep, nil)
+	if err != nil {
+		t.Fatalf("GetPlots (ConsolidateBy MAX) failed: %s", err)
+	}
+
+	avgPlots, maxPlots := avgResults["value"].Plots, maxResults["value"].Plots
+	if len(avgPlots) == 0 || len(maxPlots) == 0 {
+		t.Fatalf("expected plots from both queries, got %d (avg), %d (max)", len(avgPlots), len(maxPlots))
+	}
+
+	diverged := false
+
+	for i := 0; i < len(avgPlots) && i < len(maxPlots); i++ {
+		avg, max := float64(avgPlots[i]), float64(maxPlots[i])
+		if math.IsNaN(avg) || math.IsNaN(max) {
+			continue
+		}
+
+		if max < avg-1 {
+			t.Errorf("ConsolidateBy(\"MAX\") plot %d = %f is below the AVERAGE plot %f", i, max, avg)
+		}
+
+		if max > avg+1 {
+			diverged = true
+		}
+	}
+
+	if !diverged {
+		t.Error("expected at least one bucket where ConsolidateBy(\"MAX\") diverges from the default AVERAGE consolidation")
+	}
+}
+
+// TestConsolidationFuncFallsBackToAverage checks that requesting a consolidation function absent from
+// the metric's RRAs (here "MIN", on an AVERAGE/MAX-only RRD) still succeeds and falls back to reading
+// the AVERAGE serie, rather than failing the query or silently picking an arbitrary RRA.
+func TestConsolidationFuncFallsBackToAverage(t *testing.T) {
+	const step = 60 * time.Second
+	const pdpPerRow = 5
+
+	values := make([]float64, 40)
+	for i := range values {
+		if i%2 != 0 {
+			values[i] = 100
+		}
+	}
+
+	connector, query, start := newTestRRDSerie(t, "facette-rrd-cf-fallback-", []string{"AVERAGE", "MAX"}, pdpPerRow, step, values)
+
+	end := start.Add(time.Duration(len(values)) * step)
+	rraStep := step * pdpPerRow
+
+	avgResults, err := connector.GetPlots(query, start, end, rraStep, nil)
+	if err != nil {
+		t.Fatalf("GetPlots (default AVERAGE) failed: %s", err)
+	}
+
+	query.Series[0].ConsolidationFunc = "MIN"
+
+	minResults, err := connector.GetPlots(query, start, end, rraStep, nil)
+	if err != nil {
+		t.Fatalf("GetPlots (ConsolidationFunc \"MIN\", absent from the RRD) failed: %s", err)
+	}
+
+	avgPlots, minPlots := avgResults["value"].Plots, minResults["value"].Plots
+	if len(avgPlots) == 0 || len(minPlots) == 0 || len(avgPlots) != len(minPlots) {
+		t.Fatalf("expected matching plots from both queries, got %d (avg), %d (fallback)", len(avgPlots), len(minPlots))
+	}
+
+	for i := range avgPlots {
+		avg, fallback := float64(avgPlots[i]), float64(minPlots[i])
+		if math.IsNaN(avg) != math.IsNaN(fallback) || (!math.IsNaN(avg) && math.Abs(avg-fallback) > 1) {
+			t.Errorf("plot %d: AVERAGE = %f, fallback from requested \"MIN\" = %f, want them equal", i, avg, fallback)
+		}
+	}
+}
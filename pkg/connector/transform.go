@@ -0,0 +1,73 @@
+package connector
+
+// TransformKind identifies the operation performed by a Transform.
+type TransformKind int
+
+// Transform kinds, modeled after graphite/metrictank's function library.
+const (
+	TransformNull TransformKind = iota
+	TransformConsolidateBy
+	TransformMovingAverage
+	TransformDerivative
+	TransformNonNegativeDerivative
+	TransformScale
+	TransformOffset
+	TransformAbsoluteValue
+)
+
+// Transform represents a single step of a composable function pipeline applied to a Serie or a
+// GroupQuery before its data reaches the backend connector. Connectors compile a Serie's or
+// GroupQuery's Transforms down to whatever native expression language they support (e.g. RRD RPN);
+// the pipeline itself stays backend-agnostic so it can be shared across connectors.
+type Transform struct {
+	Kind TransformKind
+
+	// Arg carries the transform's numeric parameter, for the kinds that take one: the replacement
+	// value for TransformNull, the window size for TransformMovingAverage, the factor for
+	// TransformScale, the offset for TransformOffset.
+	Arg float64
+
+	// CF carries the consolidation function name for TransformConsolidateBy.
+	CF string
+}
+
+// NewTransformNull returns a transform replacing unknown values with def.
+func NewTransformNull(def float64) Transform {
+	return Transform{Kind: TransformNull, Arg: def}
+}
+
+// NewConsolidateBy returns a transform requesting cf as the serie's consolidation function.
+func NewConsolidateBy(cf string) Transform {
+	return Transform{Kind: TransformConsolidateBy, CF: cf}
+}
+
+// NewMovingAverage returns a transform smoothing the serie over a window of the given size.
+func NewMovingAverage(window float64) Transform {
+	return Transform{Kind: TransformMovingAverage, Arg: window}
+}
+
+// NewDerivative returns a transform emitting the rate of change between consecutive values.
+func NewDerivative() Transform {
+	return Transform{Kind: TransformDerivative}
+}
+
+// NewNonNegativeDerivative returns a transform like NewDerivative, clamped to non-negative values
+// (useful for counters that may wrap or reset).
+func NewNonNegativeDerivative() Transform {
+	return Transform{Kind: TransformNonNegativeDerivative}
+}
+
+// NewScale returns a transform multiplying the serie by factor.
+func NewScale(factor float64) Transform {
+	return Transform{Kind: TransformScale, Arg: factor}
+}
+
+// NewOffset returns a transform adding k to the serie.
+func NewOffset(k float64) Transform {
+	return Transform{Kind: TransformOffset, Arg: k}
+}
+
+// NewAbsoluteValue returns a transform replacing each value with its absolute value.
+func NewAbsoluteValue() Transform {
+	return Transform{Kind: TransformAbsoluteValue}
+}